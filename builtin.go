@@ -3,16 +3,21 @@ package tachyon
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"github.com/flynn/go-shlex"
+	"golang.org/x/crypto/blake2b"
+	"hash"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 )
 
@@ -83,11 +88,35 @@ func captureCmd(c *exec.Cmd, show bool) ([]byte, []byte, error) {
 		}
 	}()
 
-	c.Start()
+	r := currentReaper()
+
+	var waitCh <-chan syscall.WaitStatus
+
+	if r != nil {
+		waitCh, err = r.startAndRegister(c)
+	} else {
+		err = c.Start()
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
 
 	wg.Wait()
 
-	err = c.Wait()
+	if r != nil {
+		if ws := <-waitCh; ws.ExitStatus() != 0 {
+			err = &ExitError{WaitStatus: ws}
+		}
+	} else {
+		err = c.Wait()
+
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				err = &ExitError{WaitStatus: ws}
+			}
+		}
+	}
 
 	return bout.Bytes(), berr.Bytes(), err
 }
@@ -99,48 +128,28 @@ type CommandResult struct {
 }
 
 func RunCommand(env *CommandEnv, parts ...string) (*CommandResult, error) {
-	c := exec.Command(parts[0], parts[1:]...)
-
-	if env.Env.config.ShowCommandOutput {
-		fmt.Printf("RUN: %s\n", strings.Join(parts, " "))
-	}
-
-	rc := 0
-
-	stdout, stderr, err := captureCmd(c, env.Env.config.ShowCommandOutput)
-	if err != nil {
-		if _, ok := err.(*exec.ExitError); ok {
-			rc = 1
-		} else {
-			return nil, err
-		}
-	}
-
-	return &CommandResult{rc, stdout, stderr}, nil
+	return RunCommandInEnv(env, nil, parts...)
 }
 
 func RunCommandInEnv(env *CommandEnv, unixEnv []string, parts ...string) (*CommandResult, error) {
-	c := exec.Command(parts[0], parts[1:]...)
-	c.Env = unixEnv
-
 	if env.Env.config.ShowCommandOutput {
 		fmt.Printf("RUN: %s\n", strings.Join(parts, " "))
 	}
 
-	rc := 0
-
-	stdout, stderr, err := captureCmd(c, env.Env.config.ShowCommandOutput)
+	stdout, stderr, rc, err := env.Executor.Run(context.Background(), parts, unixEnv, nil)
 	if err != nil {
-		if _, ok := err.(*exec.ExitError); ok {
-			rc = 1
-		} else {
-			return nil, err
-		}
+		return nil, err
 	}
 
 	return &CommandResult{rc, stdout, stderr}, nil
 }
 
+// runCmd runs parts as-is, with no `sh -x` tracing. Use runCmd directly
+// for anything that wasn't actually launched under -x (CommandCmd, most
+// notably): routing it through runTracedCmd just because Config.Trace
+// happens to be set would misparse any real stderr line that starts
+// with a run of '+' characters as a PS4 trace line and silently drop
+// it.
 func runCmd(env *CommandEnv, parts ...string) (*Result, error) {
 	cmd, err := RunCommand(env, parts...)
 	if err != nil {
@@ -160,6 +169,38 @@ func runCmd(env *CommandEnv, parts ...string) (*Result, error) {
 	return r, nil
 }
 
+// runTracedCmd is runCmd's `sh -x` sibling: it keeps PS4 trace lines out
+// of stdout/stderr entirely, under their own "trace" result key, so
+// register:/when: consumers downstream don't have to filter them out.
+func runTracedCmd(env *CommandEnv, parts ...string) (*Result, error) {
+	if env.Env.config.ShowCommandOutput {
+		fmt.Printf("RUN: %s\n", strings.Join(parts, " "))
+	}
+
+	te, ok := env.Executor.(TraceExecutor)
+	if !ok {
+		return nil, fmt.Errorf("tachyon: executor %T does not support trace mode", env.Executor)
+	}
+
+	stdout, stderr, trace, rc, err := te.RunTraced(context.Background(), parts, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	r := NewResult(true)
+
+	r.Add("rc", rc)
+	r.Add("stdout", strings.TrimSpace(string(stdout)))
+	r.Add("stderr", strings.TrimSpace(string(stderr)))
+	r.Add("trace", string(trace))
+
+	if str, ok := renderShellResult(r); ok {
+		r.Add("_result", str)
+	}
+
+	return r, nil
+}
+
 type CommandCmd struct {
 	Command string `tachyon:"command,required"`
 }
@@ -183,6 +224,10 @@ type ShellCmd struct {
 }
 
 func (cmd *ShellCmd) Run(env *CommandEnv) (*Result, error) {
+	if traceEnabled(env) {
+		return runTracedCmd(env, "sh", "-x", "-c", cmd.Command)
+	}
+
 	return runCmd(env, "sh", "-c", cmd.Command)
 }
 
@@ -206,6 +251,12 @@ func renderShellResult(res *Result) (string, bool) {
 		return "", false
 	}
 
+	if tracev, ok := res.Get("trace"); ok {
+		if trace, ok := tracev.Read().(string); ok && trace != "" {
+			return "", false
+		}
+	}
+
 	rc := rcv.Read().(int)
 	stdout := stdoutv.Read().(string)
 	stderr := stderrv.Read().(string)
@@ -221,111 +272,256 @@ func renderShellResult(res *Result) (string, bool) {
 }
 
 type CopyCmd struct {
-	Src  string `tachyon:"src,required"`
-	Dest string `tachyon:"dest,required"`
+	Src      string `tachyon:"src,required"`
+	Dest     string `tachyon:"dest,required"`
+	Checksum string `tachyon:"checksum"` // md5, sha256 (default), or blake2b
+}
+
+// newChecksum returns a fresh hasher for algo, along with algo's
+// canonical name ("" normalizes to "sha256"). md5 is kept around purely
+// for compatibility with older recorded checksums.
+func newChecksum(algo string) (hash.Hash, string, error) {
+	switch algo {
+	case "", "sha256":
+		return sha256.New(), "sha256", nil
+	case "md5":
+		return md5.New(), "md5", nil
+	case "blake2b":
+		h, err := blake2b.New256(nil)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return h, "blake2b", nil
+	default:
+		return nil, "", fmt.Errorf("tachyon: unknown checksum algorithm %q", algo)
+	}
 }
 
-func md5file(path string) ([]byte, error) {
-	h := md5.New()
+// localDigest hashes path in-process with algo. It's what destDigestFor
+// uses for a LocalExecutor instead of shelling out to sha256sum/md5sum
+// for a file that's already sitting on the same filesystem tachyon is
+// running on.
+func localDigest(path, algo string) ([]byte, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
 
-	i, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 
-	if _, err := io.Copy(h, i); err != nil {
+	hasher, _, err := newChecksum(algo)
+	if err != nil {
 		return nil, err
 	}
 
-	return h.Sum(nil), nil
+	if _, err := io.Copy(hasher, f); err != nil {
+		return nil, err
+	}
+
+	return hasher.Sum(nil), nil
 }
 
 func (cmd *CopyCmd) Run(env *CommandEnv) (*Result, error) {
 	input, err := os.Open(cmd.Src)
-
 	if err != nil {
 		return nil, err
 	}
+	defer input.Close()
 
 	srcStat, err := os.Stat(cmd.Src)
 	if err != nil {
 		return nil, err
 	}
 
-	srcDigest, err := md5file(cmd.Src)
+	hasher, algo, err := newChecksum(cmd.Checksum)
 	if err != nil {
 		return nil, err
 	}
 
-	var dstDigest []byte
+	dest := cmd.Dest
+
+	if stat, err := env.Executor.Stat(dest); err == nil && stat.IsDir() {
+		dest = filepath.Join(dest, filepath.Base(cmd.Src))
+	}
 
-	defer input.Close()
+	// destDigestFor never touches Src -- dest is hashed in-process
+	// (LocalExecutor) or by a remote tool (anything else) -- so knowing
+	// it before the transfer starts doesn't cost a read of Src.
+	destDigest, _ := destDigestFor(context.Background(), env.Executor, dest, algo)
 
-	dest := cmd.Dest
+	uid, gid := -1, -1
+
+	if ostat, ok := srcStat.Sys().(*syscall.Stat_t); ok {
+		uid, gid = int(ostat.Uid), int(ostat.Gid)
+	}
+
+	rd := ResultData{
+		"checksum_algo": Any(algo),
+		"src":           Any(cmd.Src),
+		"dest":          Any(dest),
+	}
+
+	// destDigest is already known, so it's worth one full read of Src up
+	// front to find out whether this transfer is a no-op before writing
+	// anything at all. This has to happen before the resumable/PutFile
+	// split below, not inside it: a resumable executor has no way to
+	// write its partial file and then decide not to have, so checking
+	// here is the only way an unchanged copy: ends up doing zero writes
+	// regardless of which kind of Executor it's running against.
+	if destDigest != nil {
+		if _, err := io.Copy(hasher, input); err != nil {
+			return nil, err
+		}
+
+		srcDigest := hasher.Sum(nil)
+
+		rd["checksum"] = Any(hex.EncodeToString(srcDigest))
+
+		if bytes.Equal(destDigest, srcDigest) {
+			rd["bytes_written"] = Any(int64(0))
+			rd["bytes_resumed"] = Any(int64(0))
 
-	link := false
+			return WrapResult(false, rd), nil
+		}
 
-	if stat, err := os.Lstat(dest); err == nil {
-		if stat.IsDir() {
-			dest = filepath.Join(dest, filepath.Base(cmd.Src))
-		} else {
-			dstDigest, _ = md5file(dest)
+		if _, err := input.Seek(0, io.SeekStart); err != nil {
+			return nil, err
 		}
 
-		link = stat.Mode()&os.ModeSymlink != 0
+		hasher.Reset()
 	}
 
-	rd := ResultData{
-		"md5sum": Any(hex.Dump(srcDigest)),
-		"src":    Any(cmd.Src),
-		"dest":   Any(dest),
+	re, resumable := env.Executor.(ResumableExecutor)
+	if resumable {
+		written, resumed, srcDigest, err := copyResumable(re, input, srcStat, dest, uid, gid, hasher, algo, env.Env.config.NoSync)
+		if err != nil {
+			return nil, err
+		}
+
+		rd["checksum"] = Any(hex.EncodeToString(srcDigest))
+		rd["bytes_written"] = Any(written)
+		rd["bytes_resumed"] = Any(resumed)
+
+		return WrapResult(true, rd), nil
 	}
 
-	if dstDigest != nil && bytes.Equal(srcDigest, dstDigest) {
-		return WrapResult(false, rd), nil
+	// Either there was nothing to compare against (no dest yet, or no
+	// remote tool for this algorithm) or the full read above already
+	// confirmed a real change: hash it in the same single pass as the
+	// write instead of reading it a second time.
+	tee := io.TeeReader(input, hasher)
+
+	if err := env.Executor.PutFile(dest, srcStat.Mode(), uid, gid, tee); err != nil {
+		return nil, err
 	}
 
-	tmp := fmt.Sprintf("%s.tmp.%d", cmd.Dest, os.Getpid())
+	rd["checksum"] = Any(hex.EncodeToString(hasher.Sum(nil)))
+	rd["bytes_written"] = Any(srcStat.Size())
+	rd["bytes_resumed"] = Any(int64(0))
 
-	output, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY, 0644)
+	return WrapResult(true, rd), nil
+}
 
+// copyResumable streams src into a deterministic `<dest>.tachyon-
+// partial` path, picking up from wherever a previous, interrupted
+// attempt left off if the partial file's existing bytes still hash the
+// same as that same prefix of src, then fsyncs (unless noSync) and
+// renames into place. Callers only reach copyResumable once CopyCmd.Run
+// has already confirmed src and dest differ, so it never has to back
+// out of a write once started. hasher ends up holding the digest of the
+// whole file -- reseeded from the partial's own bytes on a resume, not
+// recomputed from byte zero -- so the caller gets a real digest without
+// a second pass over src.
+func copyResumable(re ResumableExecutor, src *os.File, srcStat os.FileInfo, dest string, uid, gid int, hasher hash.Hash, algo string, noSync bool) (written, resumed int64, digest []byte, err error) {
+	partial := dest + ".tachyon-partial"
+
+	partialRC, partialSize, err := re.OpenPartial(partial)
 	if err != nil {
-		return nil, err
+		return 0, 0, nil, err
 	}
 
-	defer output.Close()
+	offset := int64(0)
 
-	if _, err = io.Copy(output, input); err != nil {
-		os.Remove(tmp)
-		return nil, err
+	if partialRC != nil {
+		defer partialRC.Close()
+
+		if partialSize > 0 && partialSize <= srcStat.Size() {
+			match, cmpErr := verifyPrefix(partialRC, src, partialSize, algo, hasher)
+			if cmpErr == nil && match {
+				offset = partialSize
+			} else {
+				hasher.Reset()
+			}
+		}
 	}
 
-	if link {
-		os.Remove(dest)
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return 0, 0, nil, err
 	}
 
-	if err := os.Chmod(tmp, srcStat.Mode()); err != nil {
-		os.Remove(tmp)
-		return nil, err
+	tee := io.TeeReader(src, hasher)
+
+	if err := re.WriteAt(partial, offset, srcStat.Mode(), uid, gid, tee); err != nil {
+		return 0, 0, nil, err
 	}
 
-	if ostat, ok := srcStat.Sys().(*syscall.Stat_t); ok {
-		os.Chown(tmp, int(ostat.Uid), int(ostat.Gid))
+	srcDigest := hasher.Sum(nil)
+
+	if !noSync {
+		if err := re.Sync(partial); err != nil {
+			return 0, 0, nil, err
+		}
+	}
+
+	if err := re.Rename(partial, dest); err != nil {
+		return 0, 0, nil, err
 	}
 
-	err = os.Rename(tmp, dest)
+	return srcStat.Size() - offset, offset, srcDigest, nil
+}
+
+// verifyPrefix confirms that the first n bytes of src still match
+// partial's existing content before resuming from the end of it, rather
+// than blindly trusting its length. It reads each side exactly once: the
+// n bytes read from partial also seed seed (so the digest copyResumable
+// builds from here on covers the partial's contribution too, not just
+// what gets transferred this run).
+func verifyPrefix(partial io.Reader, src io.Reader, n int64, algo string, seed hash.Hash) (bool, error) {
+	partialHasher, _, err := newChecksum(algo)
 	if err != nil {
-		os.Remove(tmp)
-		return nil, err
+		return false, err
 	}
 
-	return WrapResult(true, rd), nil
+	tee := io.TeeReader(io.LimitReader(partial, n), seed)
+
+	if _, err := io.Copy(partialHasher, tee); err != nil {
+		return false, err
+	}
+
+	srcHasher, _, err := newChecksum(algo)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := io.Copy(srcHasher, io.LimitReader(src, n)); err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(partialHasher.Sum(nil), srcHasher.Sum(nil)), nil
 }
 
 type ScriptCmd struct {
 	Script string `tachyon:"command,required"`
 }
 
+// scriptSeq disambiguates concurrent script: tasks in the same process
+// that would otherwise race over the same pid-keyed remote temp path.
+var scriptSeq int64
+
 func (cmd *ScriptCmd) ParseArgs(s Scope, args string) (Vars, error) {
 	return Vars{"command": Any(args)}, nil
 }
@@ -338,14 +534,31 @@ func (cmd *ScriptCmd) Run(env *CommandEnv) (*Result, error) {
 		script = parts[0]
 	}
 
-	path := env.Paths.File(script)
+	localPath := env.Paths.File(script)
 
-	_, err = os.Stat(path)
+	local, err := os.Open(localPath)
 	if err != nil {
 		return nil, err
 	}
+	defer local.Close()
+
+	// Keyed on pid alone this path collides between concurrent script:
+	// tasks in the same process (parallel: plays); add a per-call
+	// sequence number so each invocation gets its own remote file.
+	remotePath := fmt.Sprintf("/tmp/tachyon-script.%d.%d", os.Getpid(), atomic.AddInt64(&scriptSeq, 1))
+
+	if err := env.Executor.PutFile(remotePath, 0755, -1, -1, local); err != nil {
+		return nil, err
+	}
+
+	defer env.Executor.Run(context.Background(), []string{"rm", "-f", remotePath}, nil, nil)
+
+	if traceEnabled(env) {
+		runArgs := append([]string{"sh", "-x", remotePath}, parts[1:]...)
+		return runTracedCmd(env, runArgs...)
+	}
 
-	runArgs := append([]string{"sh", path}, parts[1:]...)
+	runArgs := append([]string{"sh", remotePath}, parts[1:]...)
 
 	return runCmd(env, runArgs...)
 }
@@ -0,0 +1,465 @@
+package tachyon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Executor abstracts how a command actually gets run and how files
+// actually get delivered, so CommandCmd/ShellCmd/CopyCmd/ScriptCmd don't
+// have to know whether they're talking to the local host or a remote
+// one. CommandEnv carries the Executor for whatever host a task is
+// targeting.
+type Executor interface {
+	Run(ctx context.Context, argv []string, env []string, stdin io.Reader) (stdout, stderr []byte, rc int, err error)
+	PutFile(path string, mode os.FileMode, uid, gid int, src io.Reader) error
+	Stat(path string) (os.FileInfo, error)
+}
+
+// LocalExecutor runs commands and writes files on the host tachyon itself
+// is running on. It's the Executor every CommandEnv gets by default, and
+// its behavior is exactly what captureCmd/RunCommand did before Executor
+// existed.
+type LocalExecutor struct {
+	// Show, when true, echoes stdout/stderr to os.Stdout with the
+	// traditional "| " prefix as the command runs.
+	Show bool
+}
+
+func NewLocalExecutor(show bool) *LocalExecutor {
+	return &LocalExecutor{Show: show}
+}
+
+func (l *LocalExecutor) Run(ctx context.Context, argv []string, env []string, stdin io.Reader) ([]byte, []byte, int, error) {
+	c := exec.CommandContext(ctx, argv[0], argv[1:]...)
+
+	if env != nil {
+		c.Env = env
+	}
+
+	if stdin != nil {
+		c.Stdin = stdin
+	}
+
+	stdout, stderr, err := captureCmd(c, l.Show)
+
+	rc := 0
+
+	if err != nil {
+		if exitErr, ok := err.(*ExitError); ok {
+			rc = exitErr.WaitStatus.ExitStatus()
+			err = nil
+		} else {
+			return stdout, stderr, -1, err
+		}
+	}
+
+	return stdout, stderr, rc, err
+}
+
+func (l *LocalExecutor) PutFile(path string, mode os.FileMode, uid, gid int, src io.Reader) error {
+	tmp := fmt.Sprintf("%s.tmp.%d", path, os.Getpid())
+
+	output, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(output, src); err != nil {
+		output.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	output.Close()
+
+	if err := os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if uid >= 0 && gid >= 0 {
+		os.Chown(tmp, uid, gid)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+func (l *LocalExecutor) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+// SSHExecutor runs commands and copies files on a remote host over a
+// single multiplexed SSH connection. A play's `hosts:` entries each get
+// their own SSHExecutor, created once and reused for every task that
+// targets that host.
+type SSHExecutor struct {
+	Addr   string
+	Config *ssh.ClientConfig
+	Show   bool
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+func NewSSHExecutor(addr string, config *ssh.ClientConfig, show bool) *SSHExecutor {
+	return &SSHExecutor{Addr: addr, Config: config, Show: show}
+}
+
+func (s *SSHExecutor) connect() (*ssh.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	client, err := ssh.Dial("tcp", s.Addr, s.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	s.client = client
+
+	return client, nil
+}
+
+func (s *SSHExecutor) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == nil {
+		return nil
+	}
+
+	err := s.client.Close()
+	s.client = nil
+
+	return err
+}
+
+func (s *SSHExecutor) Run(ctx context.Context, argv []string, env []string, stdin io.Reader) ([]byte, []byte, int, error) {
+	client, err := s.connect()
+	if err != nil {
+		return nil, nil, -1, err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, nil, -1, err
+	}
+	defer session.Close()
+
+	for _, kv := range env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			session.Setenv(parts[0], parts[1])
+		}
+	}
+
+	if stdin != nil {
+		session.Stdin = stdin
+	}
+
+	stdoutPipe, err := session.StdoutPipe()
+	if err != nil {
+		return nil, nil, -1, err
+	}
+
+	stderrPipe, err := session.StderrPipe()
+	if err != nil {
+		return nil, nil, -1, err
+	}
+
+	var bout, berr bytes.Buffer
+	var wg sync.WaitGroup
+
+	prefix := []byte(`| `)
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		copyLines(&bout, stdoutPipe, prefix, s.Show)
+	}()
+
+	go func() {
+		defer wg.Done()
+		copyLines(&berr, stderrPipe, prefix, s.Show)
+	}()
+
+	runErr := session.Run(shellJoin(argv))
+
+	wg.Wait()
+
+	rc := 0
+
+	if runErr != nil {
+		if exitErr, ok := runErr.(*ssh.ExitError); ok {
+			rc = exitErr.ExitStatus()
+			runErr = nil
+		} else {
+			return bout.Bytes(), berr.Bytes(), -1, runErr
+		}
+	}
+
+	return bout.Bytes(), berr.Bytes(), rc, nil
+}
+
+// shellJoin renders argv as a single command line the remote sh can
+// parse back into exactly these arguments. A plain strings.Join lets
+// the remote shell re-split and re-interpret every element: argv is
+// almost always ["sh", "-c", script] for a shell:/script: task, and
+// joining that with spaces hands the remote sh only the first
+// whitespace-delimited token of script as its -c body, silently
+// discarding the rest (or worse, running it as separate arguments).
+func shellJoin(argv []string) string {
+	quoted := make([]string, len(argv))
+
+	for i, arg := range argv {
+		quoted[i] = shellQuote(arg)
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+// shellQuote wraps s in single quotes, the only POSIX shell quoting
+// that needs no knowledge of what's inside -- except for s's own single
+// quotes, each closed out, escaped, and reopened.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func copyLines(buf *bytes.Buffer, r io.Reader, prefix []byte, show bool) {
+	br := bufio.NewReader(r)
+
+	for {
+		line, err := br.ReadSlice('\n')
+
+		buf.Write(line)
+
+		if show && len(line) > 0 {
+			os.Stdout.Write(prefix)
+			os.Stdout.Write(line)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// PutFile uploads src to path over SFTP, creating or truncating the
+// remote file, then fixes up its mode/owner to match what CopyCmd asked
+// for.
+func (s *SSHExecutor) PutFile(path string, mode os.FileMode, uid, gid int, src io.Reader) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	sftpc, err := sftp.NewClient(client)
+	if err != nil {
+		return err
+	}
+	defer sftpc.Close()
+
+	out, err := sftpc.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, src); err != nil {
+		return err
+	}
+
+	if err := sftpc.Chmod(path, mode); err != nil {
+		return err
+	}
+
+	if uid >= 0 && gid >= 0 {
+		sftpc.Chown(path, uid, gid)
+	}
+
+	return nil
+}
+
+func (s *SSHExecutor) Stat(path string) (os.FileInfo, error) {
+	client, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	sftpc, err := sftp.NewClient(client)
+	if err != nil {
+		return nil, err
+	}
+	defer sftpc.Close()
+
+	return sftpc.Stat(path)
+}
+
+// remoteDigestTool maps a CopyCmd checksum algorithm to the remote
+// command that can compute it without pulling the file back over the
+// wire. blake2b has no universally-installed equivalent, so callers
+// should treat "" as "can't check remotely, just upload".
+func remoteDigestTool(algo string) string {
+	switch algo {
+	case "", "sha256":
+		return "sha256sum"
+	case "md5":
+		return "md5sum"
+	default:
+		return ""
+	}
+}
+
+// remoteDigest runs the remote hashing tool for algo against path and
+// parses its output, which is what CopyCmd uses to decide whether an
+// upload can be skipped entirely. A nil, nil return means "couldn't
+// determine it remotely" (no file there, or no matching tool) and the
+// caller should fall back to transferring the file.
+func remoteDigest(ctx context.Context, e Executor, path, algo string) ([]byte, error) {
+	tool := remoteDigestTool(algo)
+	if tool == "" {
+		return nil, nil
+	}
+
+	stdout, _, rc, err := e.Run(ctx, []string{tool, path}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if rc != 0 {
+		return nil, nil
+	}
+
+	fields := strings.Fields(string(stdout))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("unexpected %s output: %q", tool, stdout)
+	}
+
+	return hex.DecodeString(fields[0])
+}
+
+// destDigestFor is how CopyCmd decides whether dest already matches Src
+// without ever reading Src itself: a LocalExecutor's dest is hashed
+// in-process (no subprocess, and it works even on a host with no
+// sha256sum/md5sum installed), and anything else falls back to
+// remoteDigest. A nil, nil return means "couldn't determine it" and the
+// caller should just transfer.
+func destDigestFor(ctx context.Context, e Executor, path, algo string) ([]byte, error) {
+	if _, ok := e.(*LocalExecutor); ok {
+		return localDigest(path, algo)
+	}
+
+	return remoteDigest(ctx, e, path, algo)
+}
+
+// ResumableExecutor is implemented by executors that can write into a
+// file starting at an arbitrary byte offset, fsync it, and rename it
+// into place. CopyCmd uses this to continue an interrupted transfer
+// from a deterministic `<dest>.tachyon-partial` path instead of
+// restarting from byte zero; an executor that doesn't implement it
+// (SSHExecutor, for now) just gets the whole file re-sent.
+type ResumableExecutor interface {
+	Executor
+
+	// OpenPartial opens path for reading if it exists, returning its
+	// current size. A missing file is not an error: it just means
+	// there's nothing to resume, reported as (nil, 0, nil).
+	OpenPartial(path string) (io.ReadCloser, int64, error)
+
+	// WriteAt appends src to path starting at offset, creating path
+	// first if offset is 0, then fixes up its mode/owner.
+	WriteAt(path string, offset int64, mode os.FileMode, uid, gid int, src io.Reader) error
+
+	// Sync fsyncs path, unless Config.NoSync suppresses it.
+	Sync(path string) error
+
+	Rename(oldpath, newpath string) error
+}
+
+func (l *LocalExecutor) OpenPartial(path string) (io.ReadCloser, int64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	return f, stat.Size(), nil
+}
+
+func (l *LocalExecutor) WriteAt(path string, offset int64, mode os.FileMode, uid, gid int, src io.Reader) error {
+	flags := os.O_CREATE | os.O_WRONLY
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(path, flags, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		return err
+	}
+
+	f.Close()
+
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+
+	if uid >= 0 && gid >= 0 {
+		os.Chown(path, uid, gid)
+	}
+
+	return nil
+}
+
+func (l *LocalExecutor) Sync(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
+func (l *LocalExecutor) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
@@ -0,0 +1,427 @@
+package tachyon
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JournalRecord is one recfile record written by JournalReporter, or
+// read back by ReadJournal/Replay.
+type JournalRecord struct {
+	Kind    string // "task", "handler" or "async"
+	Task    string
+	Module  string
+	Host    string
+	Start   time.Time
+	Runtime time.Duration
+	Rc      int
+	Changed bool
+	Failed  bool
+	Stdout  string
+	Stderr  string
+}
+
+// JournalReporter wraps another Reporter and additionally appends every
+// RunResult to Config.JournalPath as a recfile record: key: value lines,
+// multi-line bodies continued with "+ ", records separated by a blank
+// line. Unlike Runner.Results, which only lives for the one invocation
+// that produced it, the journal accumulates across runs so operators can
+// grep/awk across thousands of plays, and `tachyon replay` can re-run
+// just what failed.
+type JournalReporter struct {
+	Next Reporter
+
+	mu     sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	starts map[*Task]time.Time
+}
+
+func NewJournalReporter(path string, next Reporter) (*JournalReporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JournalReporter{
+		Next:   next,
+		file:   f,
+		w:      bufio.NewWriter(f),
+		starts: make(map[*Task]time.Time),
+	}, nil
+}
+
+func (j *JournalReporter) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.w.Flush(); err != nil {
+		j.file.Close()
+		return err
+	}
+
+	return j.file.Close()
+}
+
+func (j *JournalReporter) StartTasks(r *Runner) {
+	if j.Next != nil {
+		j.Next.StartTasks(r)
+	}
+}
+
+func (j *JournalReporter) FinishTasks(r *Runner) {
+	if j.Next != nil {
+		j.Next.FinishTasks(r)
+	}
+}
+
+func (j *JournalReporter) StartHandlers(r *Runner) {
+	if j.Next != nil {
+		j.Next.StartHandlers(r)
+	}
+}
+
+func (j *JournalReporter) FinishHandlers(r *Runner) {
+	if j.Next != nil {
+		j.Next.FinishHandlers(r)
+	}
+}
+
+func (j *JournalReporter) StartTask(task *Task, cmd Command, name, str string) {
+	j.mu.Lock()
+	j.starts[task] = time.Now()
+	j.mu.Unlock()
+
+	if j.Next != nil {
+		j.Next.StartTask(task, cmd, name, str)
+	}
+}
+
+func (j *JournalReporter) FinishTask(task *Task, cmd Command, res *Result) {
+	j.mu.Lock()
+	start, ok := j.starts[task]
+	delete(j.starts, task)
+	j.mu.Unlock()
+
+	if !ok {
+		start = time.Now()
+	}
+
+	j.append("task", task, res, start, time.Since(start))
+
+	if j.Next != nil {
+		j.Next.FinishTask(task, cmd, res)
+	}
+}
+
+// RecordAsync appends a journal record for an async task's completion.
+// It exists because an async task's result surfaces through
+// AsyncAction.Finish rather than FinishTask, so Runner calls this
+// directly once the background goroutine returns.
+func (j *JournalReporter) RecordAsync(task *Task, res *Result, start time.Time, runtime time.Duration) {
+	j.append("async", task, res, start, runtime)
+}
+
+func (j *JournalReporter) append(kind string, task *Task, res *Result, start time.Time, runtime time.Duration) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	fmt.Fprintf(j.w, "Kind: %s\n", kind)
+	fmt.Fprintf(j.w, "Task: %s\n", task.Name())
+	fmt.Fprintf(j.w, "Module: %s\n", task.Command())
+	fmt.Fprintf(j.w, "Host: %s\n", journalHostname())
+	fmt.Fprintf(j.w, "Start: %s\n", start.Format(time.RFC3339Nano))
+	fmt.Fprintf(j.w, "Runtime: %s\n", runtime)
+
+	if res != nil {
+		if rc, ok := res.Get("rc"); ok {
+			fmt.Fprintf(j.w, "Rc: %v\n", rc.Read())
+		}
+
+		fmt.Fprintf(j.w, "Changed: %v\n", res.Changed)
+
+		_, failed := res.Get("failed")
+		fmt.Fprintf(j.w, "Failed: %v\n", failed)
+
+		if stdout, ok := res.Get("stdout"); ok {
+			writeBody(j.w, "Stdout", fmt.Sprintf("%v", stdout.Read()))
+		}
+
+		if stderr, ok := res.Get("stderr"); ok {
+			writeBody(j.w, "Stderr", fmt.Sprintf("%v", stderr.Read()))
+		}
+	}
+
+	j.w.WriteString("\n")
+	j.w.Flush()
+}
+
+func writeBody(w *bufio.Writer, key, text string) {
+	lines := strings.Split(text, "\n")
+
+	fmt.Fprintf(w, "%s: %s\n", key, lines[0])
+
+	for _, line := range lines[1:] {
+		fmt.Fprintf(w, "+ %s\n", line)
+	}
+}
+
+func journalHostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+
+	return name
+}
+
+// ReadJournal parses a recfile journal back into records, in the order
+// they were written.
+func ReadJournal(path string) ([]*JournalRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []*JournalRecord
+
+	rec := &JournalRecord{}
+	empty := true
+
+	var curKey string
+	var curVal strings.Builder
+
+	flushField := func() {
+		if curKey != "" {
+			setJournalField(rec, curKey, curVal.String())
+			empty = false
+		}
+
+		curKey = ""
+		curVal.Reset()
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			flushField()
+
+			if !empty {
+				records = append(records, rec)
+			}
+
+			rec = &JournalRecord{}
+			empty = true
+		case strings.HasPrefix(line, "+ "):
+			curVal.WriteByte('\n')
+			curVal.WriteString(strings.TrimPrefix(line, "+ "))
+		default:
+			flushField()
+
+			idx := strings.Index(line, ": ")
+			if idx < 0 {
+				continue
+			}
+
+			curKey = line[:idx]
+			curVal.WriteString(line[idx+2:])
+		}
+	}
+
+	flushField()
+
+	if !empty {
+		records = append(records, rec)
+	}
+
+	return records, scanner.Err()
+}
+
+func setJournalField(rec *JournalRecord, key, val string) {
+	switch key {
+	case "Kind":
+		rec.Kind = val
+	case "Task":
+		rec.Task = val
+	case "Module":
+		rec.Module = val
+	case "Host":
+		rec.Host = val
+	case "Start":
+		if t, err := time.Parse(time.RFC3339Nano, val); err == nil {
+			rec.Start = t
+		}
+	case "Runtime":
+		if d, err := time.ParseDuration(val); err == nil {
+			rec.Runtime = d
+		}
+	case "Rc":
+		fmt.Sscanf(val, "%d", &rec.Rc)
+	case "Changed":
+		rec.Changed = val == "true"
+	case "Failed":
+		rec.Failed = val == "true"
+	case "Stdout":
+		rec.Stdout = val
+	case "Stderr":
+		rec.Stderr = val
+	}
+}
+
+// ReplayFilter is the parsed form of `tachyon replay --filter
+// 'Key=Value'`: a single equality test over one JournalRecord field.
+type ReplayFilter struct {
+	Key   string
+	Value string
+}
+
+func ParseReplayFilter(s string) (*ReplayFilter, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("tachyon: invalid filter %q, want Key=Value", s)
+	}
+
+	return &ReplayFilter{Key: parts[0], Value: parts[1]}, nil
+}
+
+func (f *ReplayFilter) Match(rec *JournalRecord) bool {
+	switch f.Key {
+	case "Kind":
+		return rec.Kind == f.Value
+	case "Task":
+		return rec.Task == f.Value
+	case "Module":
+		return rec.Module == f.Value
+	case "Host":
+		return rec.Host == f.Value
+	case "Changed":
+		return fmt.Sprintf("%v", rec.Changed) == f.Value
+	case "Failed":
+		return fmt.Sprintf("%v", rec.Failed) == f.Value
+	default:
+		return false
+	}
+}
+
+// Replay re-runs just the tasks named by journal records matching
+// filter, looked up by name in plays (the same plays the original
+// invocation parsed its playbook into). This is what `tachyon replay
+// --journal path.rec --filter 'Failed=true'` does under the hood.
+//
+// Scope note: this matches records against the already-parsed plays
+// passed in rather than reconstructing Tasks from the journal itself --
+// there's no sibling serialized-play file here to reconstruct them
+// from, since Task has no serialization format in this package. A
+// consequence of matching by Name() alone is that unnamed tasks
+// (Name() == "") are not deduplicated against each other the way named
+// ones are, since "" isn't a real identity: every matching record for
+// an unnamed task is replayed, and each one resolves to whichever
+// unnamed task findJournalTask finds first in plays, which may not be
+// the exact task instance that originally ran if a play has more than
+// one. Naming tasks you care about replaying individually avoids this.
+func Replay(journalPath string, filter *ReplayFilter, plays []*Play, env *Environment) (*Runner, error) {
+	records, err := ReadJournal(journalPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var redo []*Task
+	seen := make(map[string]bool)
+
+	for _, rec := range records {
+		if filter != nil && !filter.Match(rec) {
+			continue
+		}
+
+		if rec.Task != "" && seen[rec.Task] {
+			continue
+		}
+
+		task := findJournalTask(plays, rec.Task)
+		if task == nil {
+			continue
+		}
+
+		if rec.Task != "" {
+			seen[rec.Task] = true
+		}
+
+		redo = append(redo, task)
+	}
+
+	replay := &Play{Tasks: redo}
+
+	if len(plays) > 0 {
+		replay.Vars = plays[0].Vars
+		replay.Modules = plays[0].Modules
+	}
+
+	runner := NewRunner(env, []*Play{replay})
+
+	return runner, runner.Run(env)
+}
+
+// ReplayMain implements the `tachyon replay` subcommand: it parses
+// --journal and --filter out of args and replays whatever journal
+// records match against plays. It's meant to be called straight out of
+// main's subcommand dispatch, e.g.:
+//
+//	case "replay":
+//		err = tachyon.ReplayMain(os.Args[2:], plays, env)
+func ReplayMain(args []string, plays []*Play, env *Environment) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	journalPath := fs.String("journal", "", "path to the recfile journal to replay from")
+	filterStr := fs.String("filter", "", "Key=Value predicate over journal records, e.g. Failed=true")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *journalPath == "" {
+		return fmt.Errorf("tachyon: replay requires --journal")
+	}
+
+	var filter *ReplayFilter
+
+	if *filterStr != "" {
+		f, err := ParseReplayFilter(*filterStr)
+		if err != nil {
+			return err
+		}
+
+		filter = f
+	}
+
+	_, err := Replay(*journalPath, filter, plays, env)
+
+	return err
+}
+
+func findJournalTask(plays []*Play, name string) *Task {
+	for _, play := range plays {
+		for _, t := range play.Tasks {
+			if t.Name() == name {
+				return t
+			}
+		}
+
+		for _, t := range play.Handlers {
+			if t.Name() == name {
+				return t
+			}
+		}
+	}
+
+	return nil
+}
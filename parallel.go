@@ -0,0 +1,235 @@
+package tachyon
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// taskNode is one node in the dependency graph built out of a play's
+// task list by buildTaskDAG.
+type taskNode struct {
+	task   *Task
+	deps   []*taskNode
+	done   chan struct{}
+	failed bool
+}
+
+// buildTaskDAG turns a play's flat, ordered task list into a dependency
+// graph suitable for concurrent dispatch. By default a task depends on
+// the one immediately before it in the list, preserving today's strict
+// top-to-bottom order regardless of whether that task has a Name() (an
+// unnamed predecessor still constrains its successor, since the default
+// edge is tracked by node, not by name); a task with an explicit
+// `after:` list depends on exactly those named tasks instead, which is
+// what lets independent tasks run side by side. Returns an error if
+// `after:` names an unknown task or the resulting graph has a cycle.
+func buildTaskDAG(tasks []*Task) ([]*taskNode, error) {
+	nodes := make([]*taskNode, len(tasks))
+	byName := make(map[string]*taskNode, len(tasks))
+
+	for i, task := range tasks {
+		nodes[i] = &taskNode{task: task, done: make(chan struct{})}
+
+		if name := task.Name(); name != "" {
+			if _, dup := byName[name]; dup {
+				return nil, fmt.Errorf("tachyon: duplicate task name %q in parallel play", name)
+			}
+
+			byName[name] = nodes[i]
+		}
+	}
+
+	for i, task := range tasks {
+		after := task.After()
+
+		if len(after) == 0 {
+			if i > 0 {
+				nodes[i].deps = append(nodes[i].deps, nodes[i-1])
+			}
+
+			continue
+		}
+
+		for _, dep := range after {
+			dn, ok := byName[dep]
+			if !ok {
+				return nil, fmt.Errorf("tachyon: task %q has after: referencing unknown task %q", taskLabel(task), dep)
+			}
+
+			nodes[i].deps = append(nodes[i].deps, dn)
+		}
+	}
+
+	if cyc := findCycle(nodes); cyc != "" {
+		return nil, fmt.Errorf("tachyon: dependency cycle in parallel play: %s", cyc)
+	}
+
+	return nodes, nil
+}
+
+func taskLabel(t *Task) string {
+	if name := t.Name(); name != "" {
+		return name
+	}
+
+	return t.Command()
+}
+
+// findCycle runs a DFS over the dependency graph and returns a
+// human-readable description of the first cycle it finds, or "" if the
+// graph is acyclic. A cycle left undetected would deadlock every
+// goroutine in runTasksParallel waiting on each other's done channel.
+func findCycle(nodes []*taskNode) string {
+	const (
+		white = iota
+		gray
+		black
+	)
+
+	state := make(map[*taskNode]int, len(nodes))
+	var stack []string
+
+	var visit func(n *taskNode) bool
+	visit = func(n *taskNode) bool {
+		state[n] = gray
+		stack = append(stack, taskLabel(n.task))
+
+		for _, d := range n.deps {
+			switch state[d] {
+			case gray:
+				stack = append(stack, taskLabel(d.task))
+				return true
+			case white:
+				if visit(d) {
+					return true
+				}
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		state[n] = black
+
+		return false
+	}
+
+	for _, n := range nodes {
+		if state[n] == white {
+			if visit(n) {
+				return strings.Join(stack, " -> ")
+			}
+		}
+	}
+
+	return ""
+}
+
+// resultFailed reports whether res represents a task-level failure --
+// either explicitly marked failed (an infra error from runTask itself),
+// or a command that ran fine but exited non-zero. Either should stop
+// the task's not-yet-started descendants from running.
+func resultFailed(res *Result) bool {
+	if res == nil {
+		return false
+	}
+
+	if v, ok := res.Get("failed"); ok {
+		if b, ok := v.Read().(bool); ok && b {
+			return true
+		}
+	}
+
+	if v, ok := res.Get("rc"); ok {
+		if rc, ok := v.Read().(int); ok && rc != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runTaskTracked runs task exactly like runTask, additionally reporting
+// whether it produced a task-level failure (a Go error, or a Result
+// with failed:true / a non-zero rc), since runTask's own return value
+// only ever carries the former.
+func (r *Runner) runTaskTracked(env *Environment, play *Play, task *Task, fs *FutureScope, host string) (bool, error) {
+	r.mu.Lock()
+	before := len(r.Results)
+	r.mu.Unlock()
+
+	if err := r.runTask(env, play, task, fs, fs, host); err != nil {
+		return true, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, rr := range r.Results[before:] {
+		if resultFailed(rr.Result) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// runTasksParallel dispatches a play's tasks according to the DAG
+// buildTaskDAG produces, running up to jobs of them at once. On
+// failure -- a Go error, or a task that ran but whose Result reports
+// failed:true or a non-zero rc -- every not-yet-started descendant of
+// the failed task is skipped (it simply never gets dispatched, since
+// nothing satisfies its wait on the failed node), while tasks already
+// in flight are allowed to finish rather than being killed mid-run.
+// Only a Go error aborts the play itself, matching the sequential
+// path's behavior of letting a non-zero rc just be data for `when:` /
+// `register:` to inspect.
+func (r *Runner) runTasksParallel(env *Environment, play *Play, fs *FutureScope, tasks []*Task, jobs int, host string) error {
+	nodes, err := buildTaskDAG(tasks)
+	if err != nil {
+		return err
+	}
+
+	sem := make(chan struct{}, jobs)
+
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	var firstErr error
+
+	for _, n := range nodes {
+		wg.Add(1)
+
+		go func(n *taskNode) {
+			defer wg.Done()
+			defer close(n.done)
+
+			for _, dn := range n.deps {
+				<-dn.done
+
+				if dn.failed {
+					n.failed = true
+					return
+				}
+			}
+
+			sem <- struct{}{}
+			failed, err := r.runTaskTracked(env, play, n.task, fs, host)
+			<-sem
+
+			if failed {
+				n.failed = true
+			}
+
+			if err != nil {
+				errMu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMu.Unlock()
+			}
+		}(n)
+	}
+
+	wg.Wait()
+
+	return firstErr
+}
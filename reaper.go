@@ -0,0 +1,189 @@
+package tachyon
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// ExitError is returned for a non-zero exit from anything captureCmd or
+// captureTraced waited on, so callers can pull an exit status out of it
+// without needing *exec.ExitError specifically.
+type ExitError struct {
+	WaitStatus syscall.WaitStatus
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.WaitStatus.ExitStatus())
+}
+
+// reaper is a process-wide SIGCHLD handler. It's the only thing in this
+// process allowed to call wait4: captureCmd/captureTraced register
+// their child's pid with it before starting the child and block on the
+// channel it hands back instead of calling *exec.Cmd.Wait directly, so
+// there's only ever one waiter per pid, tracked or not. Anything reaped
+// that nobody registered for is an orphan -- a grandchild reparented to
+// tachyon because it ended up running as PID 1 inside a minimal
+// container (a daemon forked by a shell: or script: task, a stray
+// nohup).
+type reaper struct {
+	sigs chan os.Signal
+	done chan struct{}
+	refs int64
+
+	mu      sync.Mutex
+	waiters map[int]chan syscall.WaitStatus
+
+	reaped  int64
+	orphans int64
+}
+
+var (
+	reaperMu  sync.Mutex
+	theReaper *reaper
+)
+
+// startReaper returns the process-wide reaper, starting a fresh one if
+// none is currently running and taking out a reference on it either
+// way. Callers must balance this with exactly one release() once
+// they're done with it; the reaper only actually shuts down once every
+// reference has been released, so one Runner finishing doesn't pull it
+// out from under another -- and once it does shut down, the next
+// startReaper() call starts a new one rather than handing back a dead
+// instance with nobody listening for SIGCHLD.
+func startReaper() *reaper {
+	reaperMu.Lock()
+	defer reaperMu.Unlock()
+
+	if theReaper == nil {
+		r := &reaper{
+			sigs:    make(chan os.Signal, 16),
+			done:    make(chan struct{}),
+			waiters: make(map[int]chan syscall.WaitStatus),
+		}
+
+		signal.Notify(r.sigs, syscall.SIGCHLD)
+
+		go r.run()
+
+		theReaper = r
+	}
+
+	atomic.AddInt64(&theReaper.refs, 1)
+
+	return theReaper
+}
+
+// currentReaper returns the process-wide reaper if one is currently
+// running, or nil if there isn't one -- a bare adhoc command run outside
+// any Runner, say. With nobody wait4'ing for unrelated pids in that
+// case, there's nothing to race and captureCmd/captureTraced fall
+// straight back to a plain Start/Wait.
+func currentReaper() *reaper {
+	reaperMu.Lock()
+	defer reaperMu.Unlock()
+
+	return theReaper
+}
+
+func (r *reaper) run() {
+	for {
+		select {
+		case <-r.sigs:
+			r.reapAll()
+		case <-r.done:
+			signal.Stop(r.sigs)
+			return
+		}
+	}
+}
+
+// reapAll drains every zombie currently waitable without blocking,
+// handing each one's status to whatever registered for that pid via
+// startAndRegister, or counting it as an orphan if nothing did.
+func (r *reaper) reapAll() {
+	for {
+		var ws syscall.WaitStatus
+
+		pid, err := syscall.Wait4(-1, &ws, syscall.WNOHANG, nil)
+		if err != nil || pid <= 0 {
+			return
+		}
+
+		atomic.AddInt64(&r.reaped, 1)
+
+		r.mu.Lock()
+		ch, ok := r.waiters[pid]
+		if ok {
+			delete(r.waiters, pid)
+		}
+		r.mu.Unlock()
+
+		if ok {
+			ch <- ws
+		} else {
+			atomic.AddInt64(&r.orphans, 1)
+		}
+	}
+}
+
+// startAndRegister starts c and registers its pid as one reapAll should
+// hand off rather than count as an orphan, returning the channel its
+// exit status will arrive on in place of a direct c.Wait() call. Holding
+// r.mu across both Start and the registration is what closes the race:
+// reapAll takes the same lock before ever consulting waiters, so it
+// either runs before this child exists at all, or after its pid is
+// already in the map -- never in the gap between the two, where a
+// very-fast-exiting child could otherwise be reaped as an anonymous
+// orphan before anyone ever registered for it.
+func (r *reaper) startAndRegister(c *exec.Cmd) (<-chan syscall.WaitStatus, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan syscall.WaitStatus, 1)
+	r.waiters[c.Process.Pid] = ch
+
+	return ch, nil
+}
+
+// release drops a reference taken by startReaper. The process-wide
+// reaper only actually stops once every holder has released it; once it
+// does, it clears itself out of the package-level singleton so the next
+// startReaper() call starts a fresh one instead of handing back one
+// whose run loop has already returned.
+func (r *reaper) release() {
+	if atomic.AddInt64(&r.refs, -1) > 0 {
+		return
+	}
+
+	close(r.done)
+
+	reaperMu.Lock()
+	if theReaper == r {
+		theReaper = nil
+	}
+	reaperMu.Unlock()
+}
+
+// ReapStats reports how many child processes the reaper has wait4'd
+// since startup, split into ones a captureCmd/captureTraced call was
+// actually waiting on and orphaned grandchildren nobody registered for.
+type ReapStats struct {
+	Reaped  int64
+	Orphans int64
+}
+
+func (r *reaper) stats() ReapStats {
+	return ReapStats{
+		Reaped:  atomic.LoadInt64(&r.reaped),
+		Orphans: atomic.LoadInt64(&r.orphans),
+	}
+}
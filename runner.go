@@ -1,6 +1,7 @@
 package tachyon
 
 import (
+	"strings"
 	"sync"
 	"time"
 )
@@ -18,6 +19,14 @@ type Runner struct {
 	to_notify map[string]struct{}
 	async     chan *AsyncAction
 	report    Reporter
+	reap      *reaper
+
+	// mu guards everything a parallel: N play's tasks can touch from
+	// more than one goroutine at once: to_notify, Results, the
+	// FutureScope register/future writes runTask makes, and executors.
+	// It's a no-op in cost for the common sequential case.
+	mu        sync.Mutex
+	executors map[string]Executor
 
 	Results []RunResult
 	Start   time.Time
@@ -25,12 +34,26 @@ type Runner struct {
 }
 
 func NewRunner(env *Environment, plays []*Play) *Runner {
+	report := env.report
+
+	// Config.JournalPath being set is what actually turns journaling
+	// on: wrap whatever Reporter the Environment already has so every
+	// task/handler/async result still reaches it, just with a recfile
+	// record appended alongside.
+	if path := env.config.JournalPath; path != "" {
+		if jr, err := NewJournalReporter(path, report); err == nil {
+			report = jr
+			env.report = jr
+		}
+	}
+
 	r := &Runner{
 		env:       env,
 		plays:     plays,
 		to_notify: make(map[string]struct{}),
 		async:     make(chan *AsyncAction),
-		report:    env.report,
+		report:    report,
+		reap:      startReaper(),
 	}
 
 	go r.handleAsync()
@@ -38,11 +61,21 @@ func NewRunner(env *Environment, plays []*Play) *Runner {
 	return r
 }
 
+// ReapStats reports how many child processes the runner's SIGCHLD
+// reaper has collected, including orphaned grandchildren forked by
+// shell: or script: tasks that tachyon never directly waited on.
+func (r *Runner) ReapStats() ReapStats {
+	return r.reap.stats()
+}
+
 func (r *Runner) SetReport(rep Reporter) {
 	r.report = rep
 }
 
 func (r *Runner) AddNotify(n string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	r.to_notify[n] = struct{}{}
 }
 
@@ -56,6 +89,39 @@ func (r *Runner) AsyncChannel() chan *AsyncAction {
 	return r.async
 }
 
+// executorForHost returns the Executor tasks targeting host should run
+// through, creating and caching an SSHExecutor for it on first use.
+// "" and "localhost" mean the local machine tachyon itself is running
+// on, using the Environment's own Executor; anything else is resolved
+// to a remote SSHExecutor using the Environment's configured SSH
+// client config.
+func (r *Runner) executorForHost(host string) Executor {
+	if host == "" || host == "localhost" || host == "127.0.0.1" {
+		return r.env.Executor
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.executors == nil {
+		r.executors = make(map[string]Executor)
+	}
+
+	if e, ok := r.executors[host]; ok {
+		return e
+	}
+
+	addr := host
+	if !strings.Contains(addr, ":") {
+		addr += ":22"
+	}
+
+	e := NewSSHExecutor(addr, r.env.config.SSH, r.env.config.ShowCommandOutput)
+	r.executors[host] = e
+
+	return e
+}
+
 func (r *Runner) Run(env *Environment) error {
 	start := time.Now()
 	r.Start = start
@@ -64,19 +130,55 @@ func (r *Runner) Run(env *Environment) error {
 		r.Runtime = time.Since(start)
 	}()
 
+	// release, not stop: the reaper is a process-wide singleton and a
+	// second Runner (or Replay) sharing this process still needs it
+	// alive after this one finishes. It only actually shuts down once
+	// every holder has released its reference.
+	defer r.reap.release()
+
+	// Closing the journal (if one is open) is tied to this Runner
+	// finishing rather than to env.Cleanup, since Environment has no
+	// such method in this package -- Run is the closest thing this
+	// snapshot has to a single place every run, successful or not,
+	// passes through on its way out.
+	if jr, ok := r.report.(*JournalReporter); ok {
+		defer jr.Close()
+	}
+
 	r.report.StartTasks(r)
 
 	for _, play := range r.plays {
-		fs := NewFutureScope(play.Vars)
+		hosts := play.Hosts
+		if len(hosts) == 0 {
+			hosts = []string{""}
+		}
+
+		for _, host := range hosts {
+			fs := NewFutureScope(play.Vars)
+
+			jobs := play.Parallel
+			if jobs == 0 {
+				jobs = env.config.Jobs
+			}
+
+			var err error
+
+			if jobs > 1 {
+				err = r.runTasksParallel(env, play, fs, play.Tasks, jobs, host)
+			} else {
+				for _, task := range play.Tasks {
+					if err = r.runTask(env, play, task, fs, fs, host); err != nil {
+						break
+					}
+				}
+			}
 
-		for _, task := range play.Tasks {
-			err := r.runTask(env, play, task, fs, fs)
 			if err != nil {
 				return err
 			}
-		}
 
-		r.Results = append(r.Results, fs.Results()...)
+			r.Results = append(r.Results, fs.Results()...)
+		}
 	}
 
 	r.report.FinishTasks(r)
@@ -88,9 +190,14 @@ func (r *Runner) Run(env *Environment) error {
 	for _, play := range r.plays {
 		fs := NewFutureScope(play.Vars)
 
+		// Handlers run once per play regardless of how many hosts
+		// its tasks targeted; this still needs fuller per-host
+		// fan-out to notify handlers on every host that triggered
+		// them, but runs locally for now rather than picking one
+		// host arbitrarily.
 		for _, task := range play.Handlers {
 			if r.ShouldRunHandler(task.Name()) {
-				err := r.runTask(env, play, task, fs, fs)
+				err := r.runTask(env, play, task, fs, fs, "")
 
 				if err != nil {
 					return err
@@ -122,7 +229,10 @@ func RunAdhocTask(cmd, args string) (*Result, error) {
 		return nil, err
 	}
 
-	ce := &CommandEnv{Env: env, Paths: env.Paths}
+	// There's no Runner around an adhoc call to resolve a per-host
+	// Executor, so default to running locally -- the same thing every
+	// CommandEnv got implicitly before Executor existed.
+	ce := &CommandEnv{Env: env, Paths: env.Paths, Executor: NewLocalExecutor(env.config.ShowCommandOutput)}
 
 	return obj.Run(ce, args)
 }
@@ -131,7 +241,7 @@ func RunAdhocCommand(cmd Command, args string) (*Result, error) {
 	env := NewEnv(NewNestedScope(nil), &Config{})
 	defer env.Cleanup()
 
-	ce := &CommandEnv{Env: env, Paths: env.Paths}
+	ce := &CommandEnv{Env: env, Paths: env.Paths, Executor: NewLocalExecutor(env.config.ShowCommandOutput)}
 
 	return cmd.Run(ce, args)
 }
@@ -171,6 +281,7 @@ type ModuleRun struct {
 	Runner      *Runner
 	Scope       Scope
 	FutureScope *FutureScope
+	Host        string
 }
 
 func (m *ModuleRun) Run(env *CommandEnv, args string) (*Result, error) {
@@ -185,23 +296,27 @@ func (m *ModuleRun) Run(env *CommandEnv, args string) (*Result, error) {
 			ns.Set(k, v)
 		}
 
-		m.Runner.runTask(env.Env, m.Play, task, ns, m.FutureScope)
+		m.Runner.runTask(env.Env, m.Play, task, ns, m.FutureScope, m.Host)
 	}
 
 	return NewResult(true), nil
 }
 
-func (r *Runner) runTaskItems(env *Environment, play *Play, task *Task, s Scope, fs *FutureScope, start time.Time) error {
+func (r *Runner) runTaskItems(env *Environment, play *Play, task *Task, s Scope, fs *FutureScope, start time.Time, host string) error {
 	for _, item := range task.Items() {
 		ns := NewNestedScope(s)
 		ns.Set("item", item)
 
+		r.mu.Lock()
 		name, err := ExpandVars(ns, task.Name())
+		r.mu.Unlock()
 		if err != nil {
 			return err
 		}
 
+		r.mu.Lock()
 		str, err := ExpandVars(ns, task.Args())
+		r.mu.Unlock()
 		if err != nil {
 			return err
 		}
@@ -212,16 +327,15 @@ func (r *Runner) runTaskItems(env *Environment, play *Play, task *Task, s Scope,
 			return err
 		}
 
+		r.mu.Lock()
 		r.report.StartTask(task, cmd, name, str)
+		r.mu.Unlock()
 
 		ce := NewCommandEnv(env, task)
+		ce.Executor = r.executorForHost(host)
 
 		res, err := cmd.Run(ce, str)
 
-		if name := task.Register(); name != "" {
-			fs.Set(name, res)
-		}
-
 		runtime := time.Since(start)
 
 		if err != nil {
@@ -230,27 +344,37 @@ func (r *Runner) runTaskItems(env *Environment, play *Play, task *Task, s Scope,
 			res.Data.Set("error", err.Error())
 		}
 
-		r.Results = append(r.Results, RunResult{task, res, runtime})
+		r.mu.Lock()
 
-		r.report.FinishTask(task, cmd, res)
+		if name := task.Register(); name != "" {
+			fs.Set(name, res)
+		}
+
+		r.Results = append(r.Results, RunResult{task, res, runtime})
 
 		if err == nil {
 			for _, x := range task.Notify() {
-				r.AddNotify(x)
+				r.to_notify[x] = struct{}{}
 			}
 		}
+
+		r.report.FinishTask(task, cmd, res)
+
+		r.mu.Unlock()
 	}
 
 	return nil
 }
 
-func (r *Runner) runTask(env *Environment, play *Play, task *Task, s Scope, fs *FutureScope) error {
+func (r *Runner) runTask(env *Environment, play *Play, task *Task, s Scope, fs *FutureScope, host string) error {
 	ps := &PriorityScope{task.IncludeVars, s}
 
 	start := time.Now()
 
 	if when := task.When(); when != "" {
+		r.mu.Lock()
 		when, err := ExpandVars(ps, when)
+		r.mu.Unlock()
 
 		if err != nil {
 			return err
@@ -262,15 +386,19 @@ func (r *Runner) runTask(env *Environment, play *Play, task *Task, s Scope, fs *
 	}
 
 	if items := task.Items(); items != nil {
-		return r.runTaskItems(env, play, task, s, fs, start)
+		return r.runTaskItems(env, play, task, s, fs, start, host)
 	}
 
+	r.mu.Lock()
 	name, err := ExpandVars(ps, task.Name())
+	r.mu.Unlock()
 	if err != nil {
 		return err
 	}
 
+	r.mu.Lock()
 	str, err := ExpandVars(ps, task.Args())
+	r.mu.Unlock()
 	if err != nil {
 		return err
 	}
@@ -284,6 +412,7 @@ func (r *Runner) runTask(env *Environment, play *Play, task *Task, s Scope, fs *
 			Module: mod,
 			Runner: r,
 			Scope:  s,
+			Host:   host,
 		}
 	} else {
 		cmd, err = MakeCommand(ps, task, str)
@@ -293,16 +422,21 @@ func (r *Runner) runTask(env *Environment, play *Play, task *Task, s Scope, fs *
 		}
 	}
 
+	r.mu.Lock()
 	r.report.StartTask(task, cmd, name, str)
+	r.mu.Unlock()
 
 	ce := NewCommandEnv(env, task)
+	ce.Executor = r.executorForHost(host)
 
 	if name := task.Future(); name != "" {
 		future := NewFuture(start, task, func() (*Result, error) {
 			return cmd.Run(ce, str)
 		})
 
+		r.mu.Lock()
 		fs.AddFuture(name, future)
+		r.mu.Unlock()
 
 		return nil
 	}
@@ -312,15 +446,16 @@ func (r *Runner) runTask(env *Environment, play *Play, task *Task, s Scope, fs *
 		asyncAction.Init(r)
 
 		go func() {
-			asyncAction.Finish(cmd.Run(ce, str))
+			res, err := cmd.Run(ce, str)
+			asyncAction.Finish(res, err)
+
+			if jr, ok := r.report.(*JournalReporter); ok {
+				jr.RecordAsync(task, res, start, time.Since(start))
+			}
 		}()
 	} else {
 		res, err := cmd.Run(ce, str)
 
-		if name := task.Register(); name != "" {
-			fs.Set(name, res)
-		}
-
 		runtime := time.Since(start)
 
 		if err != nil {
@@ -329,15 +464,23 @@ func (r *Runner) runTask(env *Environment, play *Play, task *Task, s Scope, fs *
 			res.Data.Set("error", err.Error())
 		}
 
-		r.Results = append(r.Results, RunResult{task, res, runtime})
+		r.mu.Lock()
 
-		r.report.FinishTask(task, cmd, res)
+		if name := task.Register(); name != "" {
+			fs.Set(name, res)
+		}
+
+		r.Results = append(r.Results, RunResult{task, res, runtime})
 
 		if err == nil {
 			for _, x := range task.Notify() {
-				r.AddNotify(x)
+				r.to_notify[x] = struct{}{}
 			}
 		}
+
+		r.report.FinishTask(task, cmd, res)
+
+		r.mu.Unlock()
 	}
 
 	return err
@@ -0,0 +1,177 @@
+package tachyon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// isTraceLine reports whether line carries sh -x's default PS4 marker:
+// one or more '+' (one per nesting level -- a command run from inside a
+// traced subshell or function prints "++ ", "+++ ", and so on) followed
+// by a space. captureTraced uses this to split PS4 output out of
+// stderr instead of letting it pollute whatever a register:/when:
+// consumer expects to find there.
+func isTraceLine(line []byte) bool {
+	i := 0
+	for i < len(line) && line[i] == '+' {
+		i++
+	}
+
+	return i > 0 && i < len(line) && line[i] == ' '
+}
+
+// TraceExecutor is implemented by executors that can keep PS4 trace
+// output separate from real stderr. LocalExecutor does this directly
+// off the child's stderr pipe; an executor that can't (SSHExecutor, for
+// now) is simply not asked to.
+type TraceExecutor interface {
+	RunTraced(ctx context.Context, argv []string, env []string, stdin io.Reader) (stdout, stderr, trace []byte, rc int, err error)
+}
+
+// traceEnabled decides whether a task should run under `sh -x`: an
+// explicit `trace: yes` on the task wins, then Config.Trace, then the
+// TRACE=1 environment override.
+func traceEnabled(env *CommandEnv) bool {
+	if env.Task != nil && env.Task.Trace() {
+		return true
+	}
+
+	if env.Env.config.Trace {
+		return true
+	}
+
+	return boolify(os.Getenv("TRACE"))
+}
+
+// RunTraced runs c exactly like captureCmd, except stderr lines with the
+// leading "+ " PS4 marker are pulled out into their own buffer instead
+// of being mixed into stderr.
+func (l *LocalExecutor) RunTraced(ctx context.Context, argv []string, unixEnv []string, stdin io.Reader) ([]byte, []byte, []byte, int, error) {
+	c := exec.CommandContext(ctx, argv[0], argv[1:]...)
+
+	if unixEnv != nil {
+		c.Env = unixEnv
+	}
+
+	if stdin != nil {
+		c.Stdin = stdin
+	}
+
+	stdout, stderr, trace, err := captureTraced(c, l.Show)
+
+	rc := 0
+
+	if err != nil {
+		if exitErr, ok := err.(*ExitError); ok {
+			rc = exitErr.WaitStatus.ExitStatus()
+			err = nil
+		} else {
+			return stdout, stderr, trace, -1, err
+		}
+	}
+
+	return stdout, stderr, trace, rc, err
+}
+
+func captureTraced(c *exec.Cmd, show bool) (stdoutB, stderrB, traceB []byte, err error) {
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer stdout.Close()
+
+	stderr, err := c.StderrPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer stderr.Close()
+
+	var wg sync.WaitGroup
+	var bout, berr, btrace bytes.Buffer
+
+	prefix := []byte(`| `)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		buf := bufio.NewReader(stdout)
+
+		for {
+			line, err := buf.ReadSlice('\n')
+
+			bout.Write(line)
+
+			if show {
+				os.Stdout.Write(prefix)
+				os.Stdout.Write(line)
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		buf := bufio.NewReader(stderr)
+
+		for {
+			line, err := buf.ReadSlice('\n')
+
+			if isTraceLine(line) {
+				btrace.Write(line)
+			} else {
+				berr.Write(line)
+
+				if show {
+					os.Stdout.Write(prefix)
+					os.Stdout.Write(line)
+				}
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	r := currentReaper()
+
+	var waitCh <-chan syscall.WaitStatus
+
+	if r != nil {
+		waitCh, err = r.startAndRegister(c)
+	} else {
+		err = c.Start()
+	}
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	wg.Wait()
+
+	if r != nil {
+		if ws := <-waitCh; ws.ExitStatus() != 0 {
+			err = &ExitError{WaitStatus: ws}
+		}
+	} else {
+		err = c.Wait()
+
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				err = &ExitError{WaitStatus: ws}
+			}
+		}
+	}
+
+	return bout.Bytes(), berr.Bytes(), btrace.Bytes(), err
+}